@@ -20,6 +20,14 @@ import (
 const (
 	DefaultAddress = "0.0.0.0:8081"
 	AddressEnvVar  = "AMIZONE_API_ADDRESS"
+
+	RateLimitEnvVar            = "AMIZONE_API_RATE_LIMIT"
+	TrustedProxiesEnvVar       = "AMIZONE_API_TRUSTED_PROXIES"
+	RateLimitRulesEnvVar       = "AMIZONE_API_RATE_LIMIT_RULES"
+	RateLimitDefaultIPEnvVar   = "AMIZONE_API_RATE_LIMIT_DEFAULT_IP"
+	RateLimitDefaultUserEnvVar = "AMIZONE_API_RATE_LIMIT_DEFAULT_USER"
+	RateLimitLoginIPEnvVar     = "AMIZONE_API_RATE_LIMIT_LOGIN_IP"
+	RateLimitLoginUserEnvVar   = "AMIZONE_API_RATE_LIMIT_LOGIN_USER"
 )
 
 func main() {
@@ -27,12 +35,38 @@ func main() {
 	_ = godotenv.Load(".env")
 
 	config := &server.Config{
-		Logger: logger.WithName("server"),
+		Logger:    logger.WithName("server"),
+		RateLimit: server.DefaultRateLimitConfig(),
+	}
+
+	// Budgets have no EnvOrDefault equivalent since they aren't plain values; the environment seeds them before
+	// flags are parsed instead.
+	rateLimitValues := map[string]flag.Value{
+		RateLimitRulesEnvVar:       &config.RateLimit.Rules,
+		RateLimitDefaultIPEnvVar:   &config.RateLimit.Default.PerIP,
+		RateLimitDefaultUserEnvVar: &config.RateLimit.Default.PerUser,
+		RateLimitLoginIPEnvVar:     &config.RateLimit.Login.PerIP,
+		RateLimitLoginUserEnvVar:   &config.RateLimit.Login.PerUser,
+	}
+	for key, value := range rateLimitValues {
+		if env, ok := os.LookupEnv(key); ok {
+			if err := value.Set(env); err != nil {
+				logger.Error(err, "invalid rate limit in environment", "key", key)
+				os.Exit(1)
+			}
+		}
 	}
 
 	flagSet := flag.NewFlagSet("server config", flag.ExitOnError)
 	flagSet.StringVar(&config.BindAddr, "address", EnvOrDefault(AddressEnvVar, DefaultAddress), "Address to listen on")
 	flagSet.StringVar(&config.WellKnownDir, "well-known-dir", "", "Path to the '.well_known' directory used for TLS certificate signing")
+	flagSet.BoolVar(&config.RateLimit.Enabled, "rate-limit", EnvOrDefault(RateLimitEnvVar, true), "Enable per-IP and per-user rate limiting")
+	flagSet.IntVar(&config.RateLimit.TrustedProxies, "trusted-proxies", EnvOrDefault(TrustedProxiesEnvVar, 0), "Number of reverse proxies appending to X-Forwarded-For; clients are identified by the entry that many hops from the right")
+	flagSet.Var(&config.RateLimit.Rules, "rate-limit-rule", "Route rule as name:prefix[,prefix...]:ip-budget:user-budget with budgets like 30/1m; repeatable, replaces the built-in rules")
+	flagSet.Var(&config.RateLimit.Default.PerIP, "rate-limit-default-ip", "Per-IP budget for routes without a rule, e.g. 120/1m (0 disables)")
+	flagSet.Var(&config.RateLimit.Default.PerUser, "rate-limit-default-user", "Per-user budget for routes without a rule, e.g. 60/1m (0 disables)")
+	flagSet.Var(&config.RateLimit.Login.PerIP, "rate-limit-login-ip", "Per-IP budget for requests that log in to Amizone, e.g. 10/10m (0 disables)")
+	flagSet.Var(&config.RateLimit.Login.PerUser, "rate-limit-login-user", "Per-user budget for requests that log in to Amizone, e.g. 3/10m (0 disables)")
 	flagSet.String("v", "", "log verbosity")
 	if err := flagSet.Parse(os.Args[1:]); err != nil {
 		logger.Error(err, "failed to parse flags")
@@ -0,0 +1,529 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/ditsuke/go-amizone/amizone/instrumentation"
+)
+
+// grpcMethodPrefix is the prefix of full gRPC method names for the Amizone service.
+const grpcMethodPrefix = "/go_amizone.server.proto.v1.AmizoneService/"
+
+// gatewayMetadataKey marks gRPC calls made by our own grpc-gateway over loopback. Those requests were already
+// limited by the HTTP middleware, so the gRPC interceptor lets them through when the key carries the server's token.
+const gatewayMetadataKey = "x-amizone-gateway"
+
+// RateLimit is a token bucket budget: Requests tokens are available in a burst, and they refill evenly over Period.
+// A zero RateLimit disables limiting for the dimension it is configured for.
+//
+// RateLimit implements flag.Value with the format "requests/period", e.g. "30/1m". "0" disables the budget.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Enabled returns true if the budget is usable.
+func (l RateLimit) Enabled() bool {
+	return l.Requests > 0 && l.Period > 0
+}
+
+// String implements flag.Value.
+func (l *RateLimit) String() string {
+	if l == nil || !l.Enabled() {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// Set implements flag.Value.
+func (l *RateLimit) Set(s string) error {
+	parsed, err := ParseRateLimit(s)
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// ParseRateLimit parses a budget in the "requests/period" format, e.g. "30/1m". "0" or "" disable the budget.
+func ParseRateLimit(s string) (RateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return RateLimit{}, nil
+	}
+	rawRequests, rawPeriod, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("bad rate limit %q: expected requests/period, e.g. 30/1m", s)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(rawRequests))
+	if err != nil || requests < 0 {
+		return RateLimit{}, fmt.Errorf("bad rate limit %q: invalid request count", s)
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(rawPeriod))
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("bad rate limit %q: invalid period", s)
+	}
+	return RateLimit{Requests: requests, Period: period}, nil
+}
+
+// RateLimitRule configures budgets for requests matching any of its Prefixes. Prefixes are matched against the
+// path of REST requests and against the full method name of gRPC calls, so a single rule (and its buckets) can
+// cover both ways of reaching an RPC.
+type RateLimitRule struct {
+	// Name namespaces the rule's buckets. Rules sharing a name share buckets.
+	Name     string
+	Prefixes []string
+	PerIP    RateLimit
+	PerUser  RateLimit
+}
+
+// RateLimitRules is a list of rules. It implements flag.Value so rules can be configured from the command line;
+// see ParseRateLimitRule for the format. The first Set replaces any default rules, later ones append.
+type RateLimitRules struct {
+	Rules []RateLimitRule
+	set   bool
+}
+
+// String implements flag.Value.
+func (r *RateLimitRules) String() string {
+	if r == nil {
+		return ""
+	}
+	formatted := make([]string, len(r.Rules))
+	for i, rule := range r.Rules {
+		formatted[i] = fmt.Sprintf("%s:%s:%s:%s", rule.Name, strings.Join(rule.Prefixes, ","), rule.PerIP.String(), rule.PerUser.String())
+	}
+	return strings.Join(formatted, ";")
+}
+
+// Set implements flag.Value. Multiple rules may be passed at once separated by ";".
+func (r *RateLimitRules) Set(s string) error {
+	if !r.set {
+		r.Rules = nil
+		r.set = true
+	}
+	for _, raw := range strings.Split(s, ";") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		rule, err := ParseRateLimitRule(raw)
+		if err != nil {
+			return err
+		}
+		r.Rules = append(r.Rules, rule)
+	}
+	return nil
+}
+
+// ParseRateLimitRule parses a rule in the "name:prefix[,prefix...]:ip-budget:user-budget" format, e.g.
+// "wifi:/api/v1/wifi_mac,/go_amizone.server.proto.v1.AmizoneService/RegisterWifiMac:30/1m:10/1m".
+func ParseRateLimitRule(s string) (RateLimitRule, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 4 {
+		return RateLimitRule{}, fmt.Errorf("bad rate limit rule %q: expected name:prefixes:ip-budget:user-budget", s)
+	}
+	rule := RateLimitRule{Name: strings.TrimSpace(parts[0])}
+	if rule.Name == "" {
+		return RateLimitRule{}, fmt.Errorf("bad rate limit rule %q: name is required", s)
+	}
+	for _, prefix := range strings.Split(parts[1], ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			rule.Prefixes = append(rule.Prefixes, prefix)
+		}
+	}
+	if len(rule.Prefixes) == 0 {
+		return RateLimitRule{}, fmt.Errorf("bad rate limit rule %q: at least one prefix is required", s)
+	}
+	var err error
+	if rule.PerIP, err = ParseRateLimit(parts[2]); err != nil {
+		return RateLimitRule{}, err
+	}
+	if rule.PerUser, err = ParseRateLimit(parts[3]); err != nil {
+		return RateLimitRule{}, err
+	}
+	return rule, nil
+}
+
+// RateLimitConfig configures rate limiting for both the REST and gRPC interfaces.
+type RateLimitConfig struct {
+	Enabled bool
+	// Rules are matched by their longest matching prefix. Default applies when no rule matches.
+	Rules   RateLimitRules
+	Default RateLimitRule
+	// Login is applied on top of the matched rule when the request's credentials have no cached session, i.e.
+	// when serving the request will trigger a login (and possibly a CAPTCHA solve) against Amizone. Its Prefixes
+	// are ignored.
+	Login RateLimitRule
+	// ExemptPaths are never limited (probes, metrics).
+	ExemptPaths []string
+	// TrustedProxies is the number of reverse proxies in front of the server that append to X-Forwarded-For.
+	// Clients are identified by the entry that many hops from the right, since anything further left is whatever
+	// the client sent. Zero ignores the header and uses the connection's address.
+	TrustedProxies int
+}
+
+// DefaultRateLimitConfig returns budgets that are comfortable for bots and apps, but stop a single client from
+// hammering Amizone (and our CapSolver credits) through us.
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Enabled: true,
+		Rules: RateLimitRules{Rules: []RateLimitRule{
+			{
+				Name: "wifi_mac",
+				Prefixes: []string{
+					"/api/v1/wifi_mac",
+					grpcMethodPrefix + "GetWifiMacInfo",
+					grpcMethodPrefix + "RegisterWifiMac",
+					grpcMethodPrefix + "DeregisterWifiMac",
+				},
+				PerIP:   RateLimit{Requests: 30, Period: time.Minute},
+				PerUser: RateLimit{Requests: 10, Period: time.Minute},
+			},
+			{
+				Name: "faculty_feedback",
+				Prefixes: []string{
+					"/api/v1/faculty/feedback",
+					grpcMethodPrefix + "FillFacultyFeedback",
+				},
+				PerIP:   RateLimit{Requests: 10, Period: time.Minute},
+				PerUser: RateLimit{Requests: 2, Period: time.Minute},
+			},
+		}},
+		Default: RateLimitRule{
+			Name:    "default",
+			PerIP:   RateLimit{Requests: 120, Period: time.Minute},
+			PerUser: RateLimit{Requests: 60, Period: time.Minute},
+		},
+		Login: RateLimitRule{
+			Name:    "login",
+			PerIP:   RateLimit{Requests: 10, Period: 10 * time.Minute},
+			PerUser: RateLimit{Requests: 3, Period: 10 * time.Minute},
+		},
+		ExemptPaths: []string{"/health", "/metrics", "/.well_known/"},
+	}
+}
+
+// tokenBucket is a classic token bucket. It is not safe for concurrent use; rateLimiter serializes access.
+type tokenBucket struct {
+	tokens   float64
+	updated  time.Time
+	capacity float64
+	// refill is the number of tokens added per second.
+	refill float64
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		tokens:   float64(limit.Requests),
+		updated:  now,
+		capacity: float64(limit.Requests),
+		refill:   float64(limit.Requests) / limit.Period.Seconds(),
+	}
+}
+
+func (b *tokenBucket) advance(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.refill)
+		b.updated = now
+	}
+}
+
+// untilToken returns how long until the bucket has a whole token.
+func (b *tokenBucket) untilToken() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.refill * float64(time.Second))
+}
+
+// untilFull returns how long until the bucket is full again.
+func (b *tokenBucket) untilFull() time.Duration {
+	return time.Duration((b.capacity - b.tokens) / b.refill * float64(time.Second))
+}
+
+// limitDecision is the outcome of checking a request against its buckets.
+type limitDecision struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// wait is the time until the request would be allowed (if denied) or the bucket is full again (if allowed).
+	wait time.Duration
+}
+
+// bucketCheck pairs a bucket key with the budget it is checked against.
+type bucketCheck struct {
+	key   string
+	limit RateLimit
+}
+
+// rateLimiter holds token buckets by key.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow checks every bucket and spends a token from each only if all of them have one, so a request denied by one
+// budget doesn't drain the others. A denial reports the longest wait among the exhausted buckets; an allowed request
+// reports the bucket with the fewest tokens left. ok is false if no check had an enabled budget.
+func (rl *rateLimiter) allow(checks []bucketCheck) (decision limitDecision, ok bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	buckets := make([]*tokenBucket, 0, len(checks))
+	limits := make([]RateLimit, 0, len(checks))
+	for _, check := range checks {
+		if !check.limit.Enabled() {
+			continue
+		}
+		bucket, exists := rl.buckets[check.key]
+		if !exists {
+			bucket = newTokenBucket(check.limit, now)
+			rl.buckets[check.key] = bucket
+		}
+		bucket.advance(now)
+		buckets = append(buckets, bucket)
+		limits = append(limits, check.limit)
+	}
+	if len(buckets) == 0 {
+		return limitDecision{}, false
+	}
+
+	var denied *limitDecision
+	for i, bucket := range buckets {
+		if bucket.tokens >= 1 {
+			continue
+		}
+		if wait := bucket.untilToken(); denied == nil || wait > denied.wait {
+			denied = &limitDecision{limit: limits[i].Requests, wait: wait}
+		}
+	}
+	if denied != nil {
+		return *denied, true
+	}
+
+	for i, bucket := range buckets {
+		bucket.tokens--
+		if !ok || int(bucket.tokens) < decision.remaining {
+			decision = limitDecision{
+				allowed:   true,
+				limit:     limits[i].Requests,
+				remaining: int(bucket.tokens),
+				wait:      bucket.untilFull(),
+			}
+			ok = true
+		}
+	}
+	return decision, true
+}
+
+// cleanup drops buckets that have refilled completely; they're equivalent to fresh ones.
+func (rl *rateLimiter) cleanup() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	for key, bucket := range rl.buckets {
+		bucket.advance(now)
+		if bucket.tokens >= bucket.capacity {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// cleanupLoop periodically drops idle buckets so the map doesn't grow with every IP we've ever seen.
+// It returns when ctx is done.
+func (rl *rateLimiter) cleanupLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rl.cleanup()
+		}
+	}
+}
+
+// Len returns the number of live buckets.
+func (rl *rateLimiter) Len() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.buckets)
+}
+
+// limitRequest checks a request against the rule matching route, and the login rule if the credentials have no
+// cached session.
+func limitRequest(config RateLimitConfig, limiter *rateLimiter, sessions *SessionCache, route, ip, user, pass string, hasAuth bool) (limitDecision, bool) {
+	rules := []RateLimitRule{matchRateLimitRule(config, route)}
+	if hasAuth && sessions != nil && !sessions.Has(user, pass) {
+		rules = append(rules, config.Login)
+	}
+
+	var checks []bucketCheck
+	for _, rule := range rules {
+		checks = append(checks, bucketCheck{key: rule.Name + "|ip|" + ip, limit: rule.PerIP})
+		if hasAuth {
+			checks = append(checks, bucketCheck{
+				key:   rule.Name + "|user|" + instrumentation.HashCredentials(user, pass),
+				limit: rule.PerUser,
+			})
+		}
+	}
+	return limiter.allow(checks)
+}
+
+// rateLimitMiddleware enforces per-IP and per-user budgets on REST requests according to the RateLimitConfig. Users
+// are identified by a hash of their Basic auth credentials. Responses carry RateLimit-* headers for the most
+// constrained budget that applied, and denied requests receive a 429 with a Retry-After header.
+func rateLimitMiddleware(config RateLimitConfig, limiter *rateLimiter, sessions *SessionCache, next http.Handler) http.Handler {
+	if !config.Enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, exempt := range config.ExemptPaths {
+			if strings.HasPrefix(r.URL.Path, exempt) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		user, pass, hasAuth := r.BasicAuth()
+		ip := clientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For"), config.TrustedProxies)
+		decision, limited := limitRequest(config, limiter, sessions, r.URL.Path, ip, user, pass, hasAuth)
+		if limited {
+			writeRateLimitHeaders(w, decision)
+			if !decision.allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(decision.wait)))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitUnaryInterceptor enforces the same budgets as rateLimitMiddleware on native gRPC calls, keyed by the
+// full method name. It must run before authentication, since authenticating an uncached user logs in to Amizone.
+// Calls carrying gatewayToken under gatewayMetadataKey come from our own grpc-gateway and were limited already.
+func rateLimitUnaryInterceptor(config RateLimitConfig, limiter *rateLimiter, sessions *SessionCache, gatewayToken string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !config.Enabled {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		if gatewayToken != "" {
+			for _, token := range md.Get(gatewayMetadataKey) {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(gatewayToken)) == 1 {
+					return handler(ctx, req)
+				}
+			}
+		}
+
+		remoteAddr := ""
+		if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+			remoteAddr = p.Addr.String()
+		}
+		ip := clientIP(remoteAddr, md.Get("x-forwarded-for"), config.TrustedProxies)
+
+		var user, pass string
+		var hasAuth bool
+		if authorization := md.Get("authorization"); len(authorization) > 0 {
+			if scheme, encoded, found := strings.Cut(authorization[0], " "); found && strings.EqualFold(scheme, "basic") {
+				user, pass, hasAuth = parseBasicCredentials(encoded)
+			}
+		}
+
+		decision, limited := limitRequest(config, limiter, sessions, info.FullMethod, ip, user, pass, hasAuth)
+		if !limited {
+			return handler(ctx, req)
+		}
+		_ = grpc.SetHeader(ctx, metadata.Pairs(
+			"ratelimit-limit", strconv.Itoa(decision.limit),
+			"ratelimit-remaining", strconv.Itoa(decision.remaining),
+			"ratelimit-reset", strconv.Itoa(ceilSeconds(decision.wait)),
+		))
+		if !decision.allowed {
+			_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(ceilSeconds(decision.wait))))
+			return nil, status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %ds", ceilSeconds(decision.wait))
+		}
+		return handler(ctx, req)
+	}
+}
+
+// matchRateLimitRule returns the rule with the longest prefix matching route, or the default rule.
+func matchRateLimitRule(config RateLimitConfig, route string) RateLimitRule {
+	match := config.Default
+	matchLen := -1
+	for _, rule := range config.Rules.Rules {
+		for _, prefix := range rule.Prefixes {
+			if strings.HasPrefix(route, prefix) && len(prefix) > matchLen {
+				match = rule
+				matchLen = len(prefix)
+			}
+		}
+	}
+	return match
+}
+
+func writeRateLimitHeaders(w http.ResponseWriter, d limitDecision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.wait)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP returns the IP a request originated from. With trustedProxies > 0, the X-Forwarded-For entry that many
+// hops from the right is used: each trusted proxy appends the address it received the request from, so entries to
+// the left of it are client-controlled. If the header is shorter than expected, the connection address is used.
+func clientIP(remoteAddr string, forwardedFor []string, trustedProxies int) string {
+	if trustedProxies > 0 {
+		var hops []string
+		for _, header := range forwardedFor {
+			for _, hop := range strings.Split(header, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		if len(hops) >= trustedProxies {
+			return hops[len(hops)-trustedProxies]
+		}
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
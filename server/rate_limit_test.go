@@ -0,0 +1,387 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type rateLimitRequest struct {
+	path       string
+	remoteAddr string
+	xff        string
+	user       string
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	config := RateLimitConfig{
+		Enabled: true,
+		Rules: RateLimitRules{Rules: []RateLimitRule{
+			{Name: "strict", Prefixes: []string{"/api/v1/strict"}, PerIP: RateLimit{Requests: 1, Period: time.Minute}},
+			{Name: "relaxed", Prefixes: []string{"/api/v1/strict/relaxed"}, PerIP: RateLimit{Requests: 3, Period: time.Minute}},
+			{Name: "per_user", Prefixes: []string{"/api/v1/user"}, PerUser: RateLimit{Requests: 1, Period: time.Minute}},
+		}},
+		Default:     RateLimitRule{Name: "default", PerIP: RateLimit{Requests: 2, Period: time.Minute}},
+		ExemptPaths: []string{"/health"},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	testCases := []struct {
+		name           string
+		trustedProxies int
+		requests       []rateLimitRequest
+		expected       []int
+	}{
+		{
+			name:     "default budget is exhausted after two requests",
+			requests: []rateLimitRequest{{path: "/api/v1/attendance"}, {path: "/api/v1/attendance"}, {path: "/api/v1/attendance"}},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:     "path rule is stricter than the default",
+			requests: []rateLimitRequest{{path: "/api/v1/strict"}, {path: "/api/v1/strict"}},
+			expected: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:     "longest matching prefix wins",
+			requests: []rateLimitRequest{{path: "/api/v1/strict/relaxed"}, {path: "/api/v1/strict/relaxed"}, {path: "/api/v1/strict/relaxed"}},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:     "exempt paths are never limited",
+			requests: []rateLimitRequest{{path: "/health"}, {path: "/health"}, {path: "/health"}},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name: "per-user buckets are separate across users and shared across IPs",
+			requests: []rateLimitRequest{
+				{path: "/api/v1/user", user: "alice"},
+				{path: "/api/v1/user", user: "bob"},
+				{path: "/api/v1/user", user: "alice", remoteAddr: "10.0.0.2:1234"},
+			},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name: "X-Forwarded-For is ignored without trusted proxies",
+			requests: []rateLimitRequest{
+				{path: "/api/v1/strict", xff: "1.1.1.1"},
+				{path: "/api/v1/strict", xff: "2.2.2.2"},
+			},
+			expected: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:           "spoofed X-Forwarded-For entries don't evade the limit",
+			trustedProxies: 1,
+			requests: []rateLimitRequest{
+				{path: "/api/v1/strict", xff: "1.1.1.1, 203.0.113.7"},
+				{path: "/api/v1/strict", xff: "2.2.2.2, 203.0.113.7"},
+			},
+			expected: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:           "clients behind a trusted proxy are limited separately",
+			trustedProxies: 1,
+			requests: []rateLimitRequest{
+				{path: "/api/v1/strict", xff: "203.0.113.7"},
+				{path: "/api/v1/strict", xff: "203.0.113.8"},
+			},
+			expected: []int{http.StatusOK, http.StatusOK},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			config := config
+			config.TrustedProxies = tc.trustedProxies
+			handler := rateLimitMiddleware(config, newRateLimiter(), nil, ok)
+
+			for i, r := range tc.requests {
+				rec := serveRateLimited(handler, r)
+				g.Expect(rec.Code).To(Equal(tc.expected[i]), "request %d to %s", i, r.path)
+				if rec.Code == http.StatusTooManyRequests {
+					g.Expect(rec.Header().Get("Retry-After")).ToNot(BeEmpty())
+					g.Expect(rec.Header().Get("RateLimit-Remaining")).To(Equal("0"))
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware_Headers(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	config := RateLimitConfig{
+		Enabled: true,
+		Default: RateLimitRule{
+			Name:    "default",
+			PerIP:   RateLimit{Requests: 5, Period: time.Minute},
+			PerUser: RateLimit{Requests: 3, Period: time.Minute},
+		},
+	}
+	handler := rateLimitMiddleware(config, newRateLimiter(), nil, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rec := serveRateLimited(handler, rateLimitRequest{path: "/api/v1/attendance", user: "alice"})
+	g.Expect(rec.Code).To(Equal(http.StatusOK))
+	// The per-user budget is the most constrained one.
+	g.Expect(rec.Header().Get("RateLimit-Limit")).To(Equal("3"))
+	g.Expect(rec.Header().Get("RateLimit-Remaining")).To(Equal("2"))
+	g.Expect(rec.Header().Get("RateLimit-Reset")).To(Equal("20"))
+	g.Expect(rec.Header().Get("Retry-After")).To(BeEmpty())
+}
+
+func TestRateLimitMiddleware_Login(t *testing.T) {
+	config := RateLimitConfig{
+		Enabled: true,
+		Default: RateLimitRule{Name: "default", PerUser: RateLimit{Requests: 10, Period: time.Minute}},
+		Login:   RateLimitRule{Name: "login", PerUser: RateLimit{Requests: 1, Period: time.Minute}},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	testCases := []struct {
+		name     string
+		cached   bool
+		expected []int
+	}{
+		{
+			name:     "uncached credentials are limited by the login rule",
+			cached:   false,
+			expected: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:     "cached credentials skip the login rule",
+			cached:   true,
+			expected: []int{http.StatusOK, http.StatusOK},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			sessions := NewSessionCache(time.Hour)
+			if tc.cached {
+				sessions.Set("alice", "password", nil)
+			}
+			limiter := newRateLimiter()
+			handler := rateLimitMiddleware(config, limiter, sessions, ok)
+
+			for i, expected := range tc.expected {
+				rec := serveRateLimited(handler, rateLimitRequest{path: "/api/v1/attendance", user: "alice"})
+				g.Expect(rec.Code).To(Equal(expected), "request %d", i)
+			}
+		})
+	}
+}
+
+func TestRateLimitUnaryInterceptor(t *testing.T) {
+	config := RateLimitConfig{
+		Enabled: true,
+		Rules: RateLimitRules{Rules: []RateLimitRule{
+			{Name: "wifi_mac", Prefixes: []string{grpcMethodPrefix + "RegisterWifiMac"}, PerIP: RateLimit{Requests: 1, Period: time.Minute}},
+		}},
+		Default: RateLimitRule{Name: "default", PerIP: RateLimit{Requests: 5, Period: time.Minute}},
+	}
+	handler := func(context.Context, interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+
+	testCases := []struct {
+		name     string
+		method   string
+		md       metadata.MD
+		expected []codes.Code
+	}{
+		{
+			name:     "direct calls are limited by the method rule",
+			method:   grpcMethodPrefix + "RegisterWifiMac",
+			expected: []codes.Code{codes.OK, codes.ResourceExhausted},
+		},
+		{
+			name:     "methods without a rule use the default budget",
+			method:   grpcMethodPrefix + "GetAttendance",
+			expected: []codes.Code{codes.OK, codes.OK},
+		},
+		{
+			name:     "gateway calls are not counted twice",
+			method:   grpcMethodPrefix + "RegisterWifiMac",
+			md:       metadata.Pairs(gatewayMetadataKey, "secret"),
+			expected: []codes.Code{codes.OK, codes.OK, codes.OK},
+		},
+		{
+			name:     "a wrong gateway token doesn't bypass the limit",
+			method:   grpcMethodPrefix + "RegisterWifiMac",
+			md:       metadata.Pairs(gatewayMetadataKey, "guess"),
+			expected: []codes.Code{codes.OK, codes.ResourceExhausted},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			interceptor := rateLimitUnaryInterceptor(config, newRateLimiter(), nil, "secret")
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+			ctx = metadata.NewIncomingContext(ctx, tc.md)
+
+			for i, expected := range tc.expected {
+				_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+				g.Expect(status.Code(err)).To(Equal(expected), "call %d", i)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_DeniedRequestsSpendNothing(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	limiter := newRateLimiter()
+	loose := bucketCheck{key: "loose", limit: RateLimit{Requests: 2, Period: time.Minute}}
+	tight := bucketCheck{key: "tight", limit: RateLimit{Requests: 1, Period: time.Minute}}
+
+	decision, _ := limiter.allow([]bucketCheck{loose, tight})
+	g.Expect(decision.allowed).To(BeTrue())
+	decision, _ = limiter.allow([]bucketCheck{loose, tight})
+	g.Expect(decision.allowed).To(BeFalse())
+
+	// The denial above must not have taken the loose bucket's last token.
+	decision, _ = limiter.allow([]bucketCheck{loose})
+	g.Expect(decision.allowed).To(BeTrue())
+	g.Expect(decision.remaining).To(Equal(0))
+}
+
+func TestTokenBucket_Refill(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter()
+	limiter.now = func() time.Time { return now }
+	check := []bucketCheck{{key: "k", limit: RateLimit{Requests: 2, Period: time.Minute}}}
+	allowed := func() bool {
+		decision, _ := limiter.allow(check)
+		return decision.allowed
+	}
+
+	g.Expect(allowed()).To(BeTrue())
+	g.Expect(allowed()).To(BeTrue())
+	denied, _ := limiter.allow(check)
+	g.Expect(denied.allowed).To(BeFalse())
+	g.Expect(denied.wait).To(Equal(30 * time.Second))
+
+	now = now.Add(30 * time.Second)
+	g.Expect(allowed()).To(BeTrue())
+
+	now = now.Add(time.Hour)
+	limiter.cleanup()
+	g.Expect(limiter.Len()).To(Equal(0))
+}
+
+func TestRateLimiter_CleanupLoopStops(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		newRateLimiter().cleanupLoop(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	g.Eventually(done).Should(BeClosed())
+}
+
+func TestClientIP(t *testing.T) {
+	testCases := []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   []string
+		trustedProxies int
+		expected       string
+	}{
+		{name: "remote address", remoteAddr: "10.0.0.1:1234", expected: "10.0.0.1"},
+		{name: "header ignored without trusted proxies", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"1.1.1.1"}, expected: "10.0.0.1"},
+		{name: "one proxy", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"203.0.113.7"}, trustedProxies: 1, expected: "203.0.113.7"},
+		{name: "spoofed entries are skipped", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"1.1.1.1, 2.2.2.2, 203.0.113.7"}, trustedProxies: 1, expected: "203.0.113.7"},
+		{name: "two proxies", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"1.1.1.1, 203.0.113.7", "192.168.0.1"}, trustedProxies: 2, expected: "203.0.113.7"},
+		{name: "short header falls back to remote address", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"203.0.113.7"}, trustedProxies: 2, expected: "10.0.0.1"},
+		{name: "remote address without port", remoteAddr: "10.0.0.1", expected: "10.0.0.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			g.Expect(clientIP(tc.remoteAddr, tc.forwardedFor, tc.trustedProxies)).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestParseRateLimitRule(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rule     string
+		expected RateLimitRule
+		err      bool
+	}{
+		{
+			name: "full rule",
+			rule: "wifi:/api/v1/wifi_mac,/x/Y:30/1m:10/1m",
+			expected: RateLimitRule{
+				Name:     "wifi",
+				Prefixes: []string{"/api/v1/wifi_mac", "/x/Y"},
+				PerIP:    RateLimit{Requests: 30, Period: time.Minute},
+				PerUser:  RateLimit{Requests: 10, Period: time.Minute},
+			},
+		},
+		{
+			name:     "disabled dimension",
+			rule:     "feedback:/api/v1/faculty:0:2/1m",
+			expected: RateLimitRule{Name: "feedback", Prefixes: []string{"/api/v1/faculty"}, PerUser: RateLimit{Requests: 2, Period: time.Minute}},
+		},
+		{name: "missing budget", rule: "wifi:/api/v1/wifi_mac:30/1m", err: true},
+		{name: "missing prefix", rule: "wifi::30/1m:10/1m", err: true},
+		{name: "bad period", rule: "wifi:/api:30/soon:10/1m", err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			rule, err := ParseRateLimitRule(tc.rule)
+			if tc.err {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(rule).To(Equal(tc.expected))
+		})
+	}
+}
+
+func serveRateLimited(handler http.Handler, r rateLimitRequest) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, r.path, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if r.remoteAddr != "" {
+		req.RemoteAddr = r.remoteAddr
+	}
+	if r.xff != "" {
+		req.Header.Set("X-Forwarded-For", r.xff)
+	}
+	if r.user != "" {
+		req.SetBasicAuth(r.user, "password")
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
@@ -2,11 +2,14 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	v1 "github.com/ditsuke/go-amizone/server/gen/go/v1"
 	"github.com/go-logr/logr"
@@ -18,6 +21,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 )
@@ -34,6 +38,7 @@ type Config struct {
 	Logger       logr.Logger
 	BindAddr     string
 	WellKnownDir string
+	RateLimit    RateLimitConfig
 }
 
 // NewConfig returns a Config with sensible defaults and a logr.Discard logger.
@@ -42,6 +47,7 @@ func NewConfig(bindAddress string) *Config {
 		BindAddr:     bindAddress,
 		Logger:       logr.Discard(),
 		WellKnownDir: "",
+		RateLimit:    DefaultRateLimitConfig(),
 	}
 }
 
@@ -54,11 +60,17 @@ type ApiServer struct {
 	}
 	config     *Config
 	httpServer *http.Server
+	limiter    *rateLimiter
+	// gatewayToken identifies loopback calls from our grpc-gateway to our gRPC server.
+	gatewayToken string
+	stopCleanup  context.CancelFunc
 }
 
 func New(config *Config) *ApiServer {
 	return &ApiServer{
-		config: config,
+		config:       config,
+		limiter:      newRateLimiter(),
+		gatewayToken: newGatewayToken(),
 	}
 }
 
@@ -71,6 +83,11 @@ func (s *ApiServer) Init() {
 	}
 	s.config.Logger.V(1).Info("Configuring server and router...")
 	s.router = h2c.NewHandler(s.newRouter(), &http2.Server{})
+	if s.config.RateLimit.Enabled {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopCleanup = cancel
+		go s.limiter.cleanupLoop(ctx, 5*time.Minute)
+	}
 	s.httpServer = &http.Server{
 		Addr:    s.config.BindAddr,
 		Handler: s.router,
@@ -99,6 +116,9 @@ func (s *ApiServer) ListenAndServe() error {
 
 // Stop stops the server.
 func (s *ApiServer) Stop(ctx context.Context) error {
+	if s.stopCleanup != nil {
+		s.stopCleanup()
+	}
 	return s.httpServer.Shutdown(ctx)
 }
 
@@ -106,7 +126,7 @@ func (s *ApiServer) Stop(ctx context.Context) error {
 // routers configured by the newGrpcServer and newHttpMux functions.
 func (s *ApiServer) newRouter() http.Handler {
 	grpcServer := s.newGrpcServer()
-	httpMux := s.newHttpMux()
+	httpMux := rateLimitMiddleware(s.config.RateLimit, s.limiter, globalSessionCache, s.newHttpMux())
 
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		if isGrpc(request) {
@@ -118,7 +138,10 @@ func (s *ApiServer) newRouter() http.Handler {
 }
 
 func (s *ApiServer) newGrpcServer() *grpc.Server {
-	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(grpcAuth.UnaryServerInterceptor(authorizeCtx)))
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		rateLimitUnaryInterceptor(s.config.RateLimit, s.limiter, globalSessionCache, s.gatewayToken),
+		grpcAuth.UnaryServerInterceptor(authorizeCtx),
+	))
 	v1.RegisterAmizoneServiceServer(grpcServer, NewAmizoneServiceServer())
 	reflection.Register(grpcServer)
 	return grpcServer
@@ -150,8 +173,10 @@ func (s *ApiServer) newHttpMux() *http.ServeMux {
 	} else {
 		s.config.Logger.Info("Not serving .well-known directory")
 	}
-	// grpc-gateway
-	gwMux := runtime.NewServeMux()
+	// grpc-gateway. Its calls are tagged so the gRPC rate limiter doesn't count them a second time.
+	gwMux := runtime.NewServeMux(runtime.WithMetadata(func(context.Context, *http.Request) metadata.MD {
+		return metadata.Pairs(gatewayMetadataKey, s.gatewayToken)
+	}))
 
 	_, port, err := net.SplitHostPort(s.config.BindAddr)
 	if err != nil {
@@ -186,16 +211,10 @@ func authorizeCtx(ctx context.Context) (context.Context, error) {
 	if err != nil {
 		return ctx, err
 	}
-	// Base 64 decode
-	credentials, err := base64.StdEncoding.DecodeString(credentialsEncoded)
-	if err != nil {
-		return ctx, err
-	}
-	index := strings.IndexByte(string(credentials), ':')
-	if index == -1 || index == 0 || index == len(credentials)-1 {
+	user, pass, ok := parseBasicCredentials(credentialsEncoded)
+	if !ok {
 		return ctx, status.Errorf(codes.Unauthenticated, "bad auth string")
 	}
-	user, pass := string(credentials[:index]), string(credentials[index+1:])
 
 	// Use session cache to avoid re-login per request
 	client, err := globalSessionCache.GetOrCreate(user, pass)
@@ -206,3 +225,25 @@ func authorizeCtx(ctx context.Context) (context.Context, error) {
 	}
 	return context.WithValue(ctx, ContextAmizoneClientKey, client), nil
 }
+
+// parseBasicCredentials decodes base64 encoded "user:pass" Basic auth credentials.
+func parseBasicCredentials(encoded string) (user, pass string, ok bool) {
+	credentials, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	index := strings.IndexByte(string(credentials), ':')
+	if index == -1 || index == 0 || index == len(credentials)-1 {
+		return "", "", false
+	}
+	return string(credentials[:index]), string(credentials[index+1:]), true
+}
+
+// newGatewayToken returns a random token for tagging grpc-gateway calls.
+func newGatewayToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic("failed to generate gateway token: " + err.Error())
+	}
+	return hex.EncodeToString(token)
+}
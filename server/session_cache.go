@@ -66,6 +66,15 @@ func (sc *SessionCache) Get(username, password string) *amizone.Client {
 	return session.client
 }
 
+// Has returns true if a live session is cached for the given credentials.
+func (sc *SessionCache) Has(username, password string) bool {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	session, exists := sc.sessions[sc.makeKey(username, password)]
+	return exists && time.Since(session.createdAt) <= sc.ttl
+}
+
 // Set stores a client in the cache
 func (sc *SessionCache) Set(username, password string, client *amizone.Client) {
 	key := sc.makeKey(username, password)
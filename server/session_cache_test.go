@@ -0,0 +1,26 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSessionCache_Has(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	sessions := NewSessionCache(time.Minute)
+	g.Expect(sessions.Has("alice", "password")).To(BeFalse())
+
+	sessions.Set("alice", "password", nil)
+	g.Expect(sessions.Has("alice", "password")).To(BeTrue())
+	g.Expect(sessions.Has("alice", "wrong")).To(BeFalse())
+
+	// Expired sessions don't count.
+	sessions.sessions[sessions.makeKey("alice", "password")].createdAt = time.Now().Add(-time.Hour)
+	g.Expect(sessions.Has("alice", "password")).To(BeFalse())
+
+	sessions.Delete("alice", "password")
+	g.Expect(sessions.Has("alice", "password")).To(BeFalse())
+}